@@ -6,7 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"time"
+	"sync"
 
 	// static assets
 	_ "github.com/SpectoLabs/hoverfly/statik"
@@ -41,6 +41,15 @@ type messageResponse struct {
 	Message string `json:"message"`
 }
 
+// availableModes is the whitelist of proxy modes accepted by both
+// StateHandler and the /config subsystem
+var availableModes = map[string]bool{
+	"virtualize": true,
+	"capture":    true,
+	"modify":     true,
+	"synthesize": true,
+}
+
 func (d *DBClient) startAdminInterface() {
 	// starting admin interface
 	mux := getBoneRouter(*d)
@@ -53,8 +62,11 @@ func (d *DBClient) startAdminInterface() {
 	}
 
 	n.Use(negronilogrus.NewCustomMiddleware(loglevel, &log.JSONFormatter{}, "admin"))
+	n.Use(newAdminAuthMiddleware(*d))
 	n.UseHandler(mux)
 
+	logInitialAdminToken(*d)
+
 	// admin interface starting message
 	log.WithFields(log.Fields{
 		"AdminPort": d.cfg.adminPort,
@@ -79,6 +91,10 @@ func getBoneRouter(d DBClient) *bone.Mux {
 	mux.Delete("/records", http.HandlerFunc(d.DeleteAllRecordsHandler))
 	mux.Post("/records", http.HandlerFunc(d.ImportRecordsHandler))
 
+	mux.Post("/records/uploads", http.HandlerFunc(d.StartUploadHandler))
+	mux.Patch("/records/uploads/:uuid", http.HandlerFunc(d.PatchUploadHandler))
+	mux.Put("/records/uploads/:uuid", http.HandlerFunc(d.PutUploadHandler))
+
 	mux.Get("/count", http.HandlerFunc(d.RecordsCount))
 	mux.Get("/stats", http.HandlerFunc(d.StatsHandler))
 	mux.Get("/statsws", http.HandlerFunc(d.StatsWSHandler))
@@ -86,6 +102,14 @@ func getBoneRouter(d DBClient) *bone.Mux {
 	mux.Get("/state", http.HandlerFunc(d.CurrentStateHandler))
 	mux.Post("/state", http.HandlerFunc(d.StateHandler))
 
+	mux.Get("/config", http.HandlerFunc(d.GetConfigHandler))
+	mux.Put("/config", http.HandlerFunc(d.PutConfigHandler))
+	mux.Get("/config/schema", http.HandlerFunc(d.GetConfigSchemaHandler))
+	mux.Get("/config/:jsonpath", http.HandlerFunc(d.GetConfigFieldHandler))
+	mux.Patch("/config/:jsonpath", http.HandlerFunc(d.PatchConfigHandler))
+
+	mux.Post("/middleware", http.HandlerFunc(d.PostMiddlewareHandler))
+
 	mux.Handle("/*", http.FileServer(statikFS))
 
 	return mux
@@ -179,6 +203,11 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// statsHub is the single broadcaster shared by every /statsws connection;
+// it's started lazily on the first upgrade
+var statsHubInstance *statsHub
+var statsHubOnce sync.Once
+
 // categoryWSFilterHandler is used for searching categories based on names and keywords through the websocket
 func (d *DBClient) StatsWSHandler(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -187,82 +216,105 @@ func (d *DBClient) StatsWSHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	statsHubOnce.Do(func() {
+		statsHubInstance = newStatsHub(*d)
+		statsHubInstance.start()
+	})
+
+	runStatsClient(statsHubInstance, conn)
+}
+
+// storePayload recalculates a payload's request hash and writes it to cache,
+// shared by both the streaming import handler and the resumable upload flow
+func storePayload(d *DBClient, pl Payload) error {
+	bts, err := pl.encode()
+	if err != nil {
+		return err
+	}
+
+	r := request{details: pl.Request}
+	return d.cache.Set([]byte(r.hash()), bts)
+}
+
+// importPayloadStream reads a `{"data": [...]}` document from dec one
+// Payload at a time, storing each as it's decoded instead of buffering the
+// whole body, and returns how many were imported
+func importPayloadStream(d *DBClient, dec *json.Decoder) (int, error) {
+	imported := 0
+
+	// walk down to the "data" array without loading the rest of the document
 	for {
-		messageType, p, err := conn.ReadMessage()
+		tok, err := dec.Token()
 		if err != nil {
-			return
+			return imported, err
 		}
-		log.WithFields(log.Fields{
-			"message": string(p),
-		}).Info("Got message...")
-
-		for _ = range time.Tick(1 * time.Second) {
 
-			stats := d.counter.Flush()
-			var sr statsResponse
-			sr.Stats = stats
+		if key, ok := tok.(string); ok && key == "data" {
+			break
+		}
+	}
 
-			b, err := json.Marshal(sr)
+	open, err := dec.Token()
+	if err != nil {
+		return imported, err
+	}
+	if delim, ok := open.(json.Delim); !ok || delim != '[' {
+		return imported, fmt.Errorf("expected 'data' to be a JSON array")
+	}
 
-			if err = conn.WriteMessage(messageType, b); err != nil {
-				log.WithFields(log.Fields{
-					"message": p,
-					"error":   err.Error(),
-				}).Error("Got error when writing message...")
-				return
-			}
+	for dec.More() {
+		var pl Payload
+		if err := dec.Decode(&pl); err != nil {
+			return imported, err
 		}
 
+		if err := storePayload(d, pl); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("Failed to encode payload")
+			continue
+		}
+		imported++
 	}
 
+	return imported, nil
 }
 
-// ImportRecordsHandler - accepts JSON payload and saves it to cache
+// ImportRecordsHandler - accepts a JSON payload and streams it to cache
+// without buffering the whole body in memory, so multi-GB capture dumps
+// don't need to fit in RAM. For resumable uploads of very large archives see
+// the /records/uploads endpoints in uploads.go.
 func (d *DBClient) ImportRecordsHandler(w http.ResponseWriter, req *http.Request) {
-
-	var requests recordedRequests
-
 	defer req.Body.Close()
-	body, err := ioutil.ReadAll(req.Body)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	var response messageResponse
 
+	dec := json.NewDecoder(req.Body)
+	imported, err := importPayloadStream(d, dec)
+
 	if err != nil {
-		// failed to read response body
 		log.WithFields(log.Fields{
 			"error": err.Error(),
-		}).Error("Could not read response body!")
-		response.Message = "Bad request. Nothing to import!"
-		http.Error(w, "Failed to read request body.", 400)
-		return
-	}
-
-	err = json.Unmarshal(body, &requests)
+		}).Error("Failed to import records")
 
-	if err != nil {
-		w.WriteHeader(422) // can't process this entity
+		if imported == 0 {
+			response.Message = "Bad request. Nothing to import!"
+			w.WriteHeader(422) // can't process this entity
+		} else {
+			response.Message = fmt.Sprintf("Import stopped after %d requests: %s", imported, err.Error())
+			w.WriteHeader(http.StatusMultiStatus) // partially imported, client must know it was truncated
+		}
+		b, _ := json.Marshal(response)
+		w.Write(b)
 		return
 	}
 
-	payloads := requests.Data
-	if len(payloads) > 0 {
-		for _, pl := range payloads {
-			bts, err := pl.encode()
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err.Error(),
-				}).Error("Failed to encode payload")
-			} else {
-				// recalculating request hash and storing it in database
-				r := request{details: pl.Request}
-				d.cache.Set([]byte(r.hash()), bts)
-			}
-		}
-		response.Message = fmt.Sprintf("%d requests imported successfully", len(payloads))
-	} else {
+	if imported == 0 {
 		response.Message = "Bad request. Nothing to import!"
 		w.WriteHeader(400)
+	} else {
+		response.Message = fmt.Sprintf("%d requests imported successfully", imported)
 	}
 
 	b, err := json.Marshal(response)
@@ -335,13 +387,6 @@ func (d *DBClient) StateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	availableModes := map[string]bool{
-		"virtualize": true,
-		"capture":    true,
-		"modify":     true,
-		"synthesize": true,
-	}
-
 	if !availableModes[sr.Mode] {
 		log.WithFields(log.Fields{
 			"suppliedMode": sr.Mode,
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/negroni"
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// role identifies what an authenticated admin request is allowed to do
+type role string
+
+const (
+	roleReadOnly role = "read-only"
+	roleAdmin    role = "admin"
+)
+
+// readOnlyPaths lists the GET endpoints a read-only token may call; anything
+// else (POST/DELETE/PUT/PATCH, or a path not in this list) requires roleAdmin.
+// /config/{jsonpath} is matched separately in isReadOnlyAllowed since its
+// path varies per field.
+var readOnlyPaths = map[string]bool{
+	"/records": true,
+	"/stats":   true,
+	"/statsws": true,
+	"/count":   true,
+	"/state":   true,
+	"/config":  true,
+}
+
+// tokenClaims is the payload embedded in admin JWTs
+type tokenClaims struct {
+	Role role `json:"role"`
+	jwt.StandardClaims
+}
+
+// newAdminAuthMiddleware builds the negroni handler that guards the admin
+// interface. It is a no-op when authentication isn't configured, so existing
+// deployments that don't opt in keep working exactly as before.
+func newAdminAuthMiddleware(d DBClient) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if !d.cfg.authEnabled {
+			next(w, r)
+			return
+		}
+
+		rl, ok := authenticate(d, r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hoverfly admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if rl != roleAdmin && !isReadOnlyAllowed(r) {
+			http.Error(w, "Forbidden: read-only token cannot perform this request", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// isReadOnlyAllowed reports whether the request is a GET against one of the
+// endpoints a read-only role is permitted to see
+func isReadOnlyAllowed(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if readOnlyPaths[r.URL.Path] {
+		return true
+	}
+	// GET /config/{jsonpath} and GET /config/schema cover every field of the
+	// same document readOnlyPaths["/config"] already allows, so a read-only
+	// token gets the same access to the path form as to the whole document
+	return strings.HasPrefix(r.URL.Path, "/config/")
+}
+
+// authenticate validates the Authorization header against either a bearer
+// JWT or, if configured, HTTP basic auth, returning the resolved role
+func authenticate(d DBClient, r *http.Request) (role, bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", false
+	}
+
+	if strings.HasPrefix(header, "Bearer ") {
+		return authenticateBearer(d, strings.TrimPrefix(header, "Bearer "))
+	}
+
+	if strings.HasPrefix(header, "Basic ") && d.cfg.authBasicEnabled {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			return "", false
+		}
+		return authenticateBasic(d, user, pass)
+	}
+
+	return "", false
+}
+
+func authenticateBearer(d DBClient, rawToken string) (role, bool) {
+	claims := &tokenClaims{}
+
+	token, err := jwt.ParseWithClaims(rawToken, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return []byte(d.cfg.authSecret), nil
+	})
+
+	if err != nil || !token.Valid {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Debug("Rejected admin token")
+		return "", false
+	}
+
+	if claims.Role != roleAdmin && claims.Role != roleReadOnly {
+		return "", false
+	}
+
+	return claims.Role, true
+}
+
+func authenticateBasic(d DBClient, user, pass string) (role, bool) {
+	if subtle.ConstantTimeCompare([]byte(user), []byte(d.cfg.authUsername)) != 1 {
+		return "", false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(d.cfg.authPasswordHash), []byte(pass)) != nil {
+		return "", false
+	}
+
+	return roleAdmin, true
+}
+
+// generateAdminToken mints a bearer token for the given role, used by
+// logInitialAdminToken to hand an operator an admin token at startup
+func generateAdminToken(d DBClient, rl role, ttl time.Duration) (string, error) {
+	claims := tokenClaims{
+		Role: rl,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+			IssuedAt:  time.Now().Unix(),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(d.cfg.authSecret))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+)
+
+// auth flags: CLI flags (with environment variable fallbacks, matching the
+// rest of Hoverfly's flag set) that configure the admin auth subsystem in
+// auth.go. They're declared at package scope, the same way the other
+// top-level flags are, so kingpin.Parse() in main picks them up for free.
+var (
+	authEnabledFlag = kingpin.Flag("auth-enabled", "Require authentication on the admin API").
+			Envar("HoverflyAuthEnabled").Default("false").Bool()
+
+	authBasicEnabledFlag = kingpin.Flag("auth-basic-enabled", "Also accept HTTP Basic auth on the admin API, in addition to bearer tokens").
+				Envar("HoverflyAuthBasicEnabled").Default("false").Bool()
+
+	authSecretFlag = kingpin.Flag("auth-secret", "HMAC secret used to sign and verify admin JWTs; generated at random (and not logged) if left empty").
+			Envar("HoverflyAuthSecret").String()
+
+	authUsernameFlag = kingpin.Flag("auth-username", "Username accepted for HTTP Basic admin auth").
+				Envar("HoverflyAuthUsername").String()
+
+	authPasswordHashFlag = kingpin.Flag("auth-password-hash", "bcrypt hash of the password accepted for HTTP Basic admin auth").
+				Envar("HoverflyAuthPasswordHash").String()
+)
+
+// ApplyAuthFlags copies the parsed auth flags into cfg. Call it from main
+// once kingpin.Parse() has run, alongside the rest of the flag-to-cfg
+// wiring. If auth is enabled without a pinned secret, a random one is
+// generated so the process still comes up with a usable (if single-run)
+// HMAC key instead of refusing to start.
+func ApplyAuthFlags(cfg *Configuration) {
+	cfg.authEnabled = *authEnabledFlag
+	cfg.authBasicEnabled = *authBasicEnabledFlag
+	cfg.authSecret = *authSecretFlag
+	cfg.authUsername = *authUsernameFlag
+	cfg.authPasswordHash = *authPasswordHashFlag
+
+	if cfg.authEnabled && cfg.authSecret == "" {
+		cfg.authSecret = generateAuthSecret()
+	}
+}
+
+// generateAuthSecret returns a random base32-encoded HMAC secret, used when
+// auth is enabled but no --auth-secret/HoverflyAuthSecret was supplied
+func generateAuthSecret() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Fatal("Failed to generate admin auth secret")
+	}
+	return base32.StdEncoding.EncodeToString(raw)
+}
+
+// logInitialAdminToken mints a bearer token for the admin role and logs it
+// once at startup, giving an operator who enabled auth a way into an
+// otherwise locked-down admin API without a separate provisioning step
+func logInitialAdminToken(d DBClient) {
+	if !d.cfg.authEnabled {
+		return
+	}
+
+	token, err := generateAdminToken(d, roleAdmin, 24*time.Hour)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to mint initial admin token")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"token": token,
+	}).Warn("Generated initial admin bearer token for the admin API; it will not be shown again")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-zoo/bone"
+)
+
+// configMu serializes the check-then-apply sequence in PutConfigHandler and
+// PatchConfigHandler so two concurrent requests that both observed the same
+// fingerprint can't both pass the If-Match check and clobber one another;
+// only one of them will see the fingerprint it expects once it holds the
+// lock, the other gets a 409 like it would against a sole writer.
+var configMu sync.Mutex
+
+// configDocument is the full runtime configuration exposed through
+// GET/PUT /config and, field by field, through GET/PATCH /config/{jsonpath}
+type configDocument struct {
+	Mode              string `json:"mode"`
+	Destination       string `json:"destination"`
+	MiddlewareCommand string `json:"middleware"`
+	MiddlewareID      string `json:"middlewareId"` // content-addressed ID of the active registry module, see middleware_registry.go
+	AdminPort         string `json:"adminPort"`
+	ProxyPort         string `json:"proxyPort"`
+	CacheTTL          int    `json:"cacheTTL"`
+}
+
+// configFingerprint hashes a configDocument's canonical JSON so clients can
+// detect a stale read with an If-Match check before writing it back
+func configFingerprint(doc configDocument) (string, []byte, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%x", sum), b, nil
+}
+
+func currentConfigDocument(d DBClient) configDocument {
+	return configDocument{
+		Mode:              d.cfg.GetMode(),
+		Destination:       d.cfg.destination,
+		MiddlewareCommand: d.cfg.middleware,
+		MiddlewareID:      d.cfg.activeMiddlewareID,
+		AdminPort:         d.cfg.adminPort,
+		ProxyPort:         d.cfg.proxyPort,
+		CacheTTL:          d.cfg.cacheTTL,
+	}
+}
+
+// applyConfigDocument pushes every field of doc into the live config; mode
+// is validated the same way StateHandler already validates it. adminPort
+// and proxyPort are read-only: the admin/proxy listeners are already bound
+// to them, so a document that tries to change one is rejected rather than
+// silently ignored.
+func applyConfigDocument(d *DBClient, doc configDocument) error {
+	if !availableModes[doc.Mode] {
+		return fmt.Errorf("bad mode supplied, available modes: virtualize, capture, modify, synthesize")
+	}
+
+	if doc.AdminPort != d.cfg.adminPort {
+		return fmt.Errorf("adminPort is read-only; restart Hoverfly with a different --admin-port to change it")
+	}
+	if doc.ProxyPort != d.cfg.proxyPort {
+		return fmt.Errorf("proxyPort is read-only; restart Hoverfly with a different --proxy-port to change it")
+	}
+
+	if doc.MiddlewareID != "" {
+		middlewareMu.Lock()
+		_, ok := middlewares[doc.MiddlewareID]
+		middlewareMu.Unlock()
+		if !ok {
+			return fmt.Errorf("no middleware registered with id %s, upload it via POST /middleware first", doc.MiddlewareID)
+		}
+	}
+
+	d.cfg.SetMode(doc.Mode)
+	d.cfg.destination = doc.Destination
+	d.cfg.middleware = doc.MiddlewareCommand
+	d.cfg.activeMiddlewareID = doc.MiddlewareID
+	d.cfg.cacheTTL = doc.CacheTTL
+
+	return nil
+}
+
+// writeConfigResponse marshals doc and stamps the response with its
+// fingerprint as an ETag, mirroring the If-Match contract PUT/PATCH expect
+func writeConfigResponse(w http.ResponseWriter, doc configDocument) {
+	fingerprint, b, err := configFingerprint(doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("ETag", fingerprint)
+	w.Write(b)
+}
+
+// GetConfigHandler returns the full runtime config document: GET /config
+func (d *DBClient) GetConfigHandler(w http.ResponseWriter, req *http.Request) {
+	writeConfigResponse(w, currentConfigDocument(*d))
+}
+
+// PutConfigHandler replaces the whole runtime config document: PUT /config.
+// The request must carry an If-Match header matching the current
+// fingerprint, otherwise it's rejected with 409 Conflict. The fingerprint
+// check and the write are done under configMu so two concurrent requests
+// that both read the same fingerprint can't both pass the check: whichever
+// acquires the lock second re-checks against the fingerprint the first one
+// just left behind and gets its own 409.
+func (d *DBClient) PutConfigHandler(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	var doc configDocument
+	if err := json.NewDecoder(req.Body).Decode(&doc); err != nil {
+		http.Error(w, "Failed to parse config document", http.StatusBadRequest)
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	current := currentConfigDocument(*d)
+	fingerprint, _, err := configFingerprint(current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != fingerprint {
+		http.Error(w, "Config has changed since it was last read, refresh and retry", http.StatusConflict)
+		return
+	}
+
+	if err := applyConfigDocument(d, doc); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Rejected config update")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeConfigResponse(w, currentConfigDocument(*d))
+}
+
+// PatchConfigHandler updates a single field addressed by its JSON path
+// (currently a single top-level field name, e.g. "mode" or "destination"):
+// PATCH /config/{jsonpath}. See PutConfigHandler for why the
+// check-then-apply sequence runs under configMu.
+func (d *DBClient) PatchConfigHandler(w http.ResponseWriter, req *http.Request) {
+	path := bone.GetValue(req, "jsonpath")
+
+	defer req.Body.Close()
+	var value json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&value); err != nil {
+		http.Error(w, "Failed to parse field value", http.StatusBadRequest)
+		return
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	current := currentConfigDocument(*d)
+	fingerprint, _, err := configFingerprint(current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != fingerprint {
+		http.Error(w, "Config has changed since it was last read, refresh and retry", http.StatusConflict)
+		return
+	}
+
+	doc := current
+	if err := setConfigField(&doc, path, value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := applyConfigDocument(d, doc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeConfigResponse(w, currentConfigDocument(*d))
+}
+
+// GetConfigFieldHandler returns a single field of the config document: GET
+// /config/{jsonpath}. The response carries the same ETag fingerprint as
+// GET/PUT /config, so a client can PATCH the field back with an If-Match
+// from this response alone, without a separate GET /config round trip.
+func (d *DBClient) GetConfigFieldHandler(w http.ResponseWriter, req *http.Request) {
+	path := bone.GetValue(req, "jsonpath")
+
+	current := currentConfigDocument(*d)
+	fingerprint, b, err := configFingerprint(current)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var asMap map[string]json.RawMessage
+	if err := json.Unmarshal(b, &asMap); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	value, ok := asMap[path]
+	if !ok {
+		http.Error(w, fmt.Sprintf("No such config field: %s", path), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("ETag", fingerprint)
+	w.Write(value)
+}
+
+// setConfigField writes value into doc's field named by jsonField, using
+// its JSON tag as the lookup key; only top-level fields are supported
+func setConfigField(doc *configDocument, jsonField string, value json.RawMessage) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	var asMap map[string]json.RawMessage
+	if err := json.Unmarshal(b, &asMap); err != nil {
+		return err
+	}
+
+	if _, ok := asMap[jsonField]; !ok {
+		return fmt.Errorf("No such config field: %s", jsonField)
+	}
+	asMap[jsonField] = value
+
+	merged, err := json.Marshal(asMap)
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(bytes.NewReader(merged)).Decode(doc)
+}
+
+// configSchema is the JSON Schema describing configDocument, served from
+// GET /config/schema so UIs can validate edits before submitting them
+var configSchema = map[string]interface{}{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type":    "object",
+	"properties": map[string]interface{}{
+		"mode": map[string]interface{}{
+			"type": "string",
+			"enum": []string{"virtualize", "capture", "modify", "synthesize"},
+		},
+		"destination":  map[string]interface{}{"type": "string"},
+		"middleware":   map[string]interface{}{"type": "string"},
+		"middlewareId": map[string]interface{}{"type": "string", "description": "content-addressed ID of a module uploaded via POST /middleware"},
+		"adminPort":    map[string]interface{}{"type": "string", "readOnly": true},
+		"proxyPort":    map[string]interface{}{"type": "string", "readOnly": true},
+		"cacheTTL":     map[string]interface{}{"type": "integer", "minimum": 0},
+	},
+	"required": []string{"mode"},
+}
+
+// GetConfigSchemaHandler returns the JSON Schema for configDocument:
+// GET /config/schema
+func (d *DBClient) GetConfigSchemaHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(configSchema)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(b)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-zoo/bone"
+)
+
+func testConfigDBClient() DBClient {
+	return DBClient{cfg: &Configuration{
+		mode:        "virtualize",
+		destination: "example.com",
+		adminPort:   "8888",
+		proxyPort:   "8500",
+	}}
+}
+
+func Test_applyConfigDocument_rejectsPortChanges(t *testing.T) {
+	d := testConfigDBClient()
+	doc := currentConfigDocument(d)
+	doc.AdminPort = "9999"
+
+	if err := applyConfigDocument(&d, doc); err == nil {
+		t.Fatal("expected changing adminPort to be rejected")
+	}
+
+	doc = currentConfigDocument(d)
+	doc.ProxyPort = "9999"
+
+	if err := applyConfigDocument(&d, doc); err == nil {
+		t.Fatal("expected changing proxyPort to be rejected")
+	}
+}
+
+func Test_applyConfigDocument_appliesWritableFields(t *testing.T) {
+	d := testConfigDBClient()
+	doc := currentConfigDocument(d)
+	doc.Destination = "changed.example.com"
+	doc.Mode = "capture"
+
+	if err := applyConfigDocument(&d, doc); err != nil {
+		t.Fatalf("applyConfigDocument: %s", err)
+	}
+
+	if d.cfg.destination != "changed.example.com" || d.cfg.GetMode() != "capture" {
+		t.Fatalf("expected writable fields to be applied, got destination=%s mode=%s", d.cfg.destination, d.cfg.GetMode())
+	}
+}
+
+func Test_GetConfigFieldHandler_setsETagMatchingWholeDocument(t *testing.T) {
+	d := testConfigDBClient()
+
+	want, _, err := configFingerprint(currentConfigDocument(d))
+	if err != nil {
+		t.Fatalf("configFingerprint: %s", err)
+	}
+
+	mux := bone.New()
+	mux.Get("/config/:jsonpath", http.HandlerFunc(d.GetConfigFieldHandler))
+
+	req := httptest.NewRequest(http.MethodGet, "/config/destination", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("ETag"); got != want {
+		t.Errorf("GetConfigFieldHandler ETag = %q, want %q", got, want)
+	}
+}
+
+// Test_PutConfigHandler_underConcurrentWriters_onlyOneWins drives the real
+// handler over HTTP: two clients both GET the same config, then race to PUT
+// a change back with that read's ETag as If-Match. It pins the actual code
+// path (configMu held across check-then-apply in PutConfigHandler), not a
+// hand-rolled copy of the locking, so it'd catch a regression that removed
+// configMu.Lock() from the handler itself.
+func Test_PutConfigHandler_underConcurrentWriters_onlyOneWins(t *testing.T) {
+	d := testConfigDBClient()
+
+	mux := bone.New()
+	mux.Get("/config", http.HandlerFunc(d.GetConfigHandler))
+	mux.Put("/config", http.HandlerFunc(d.PutConfigHandler))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	getResp, err := http.Get(srv.URL + "/config")
+	if err != nil {
+		t.Fatalf("GET /config: %s", err)
+	}
+	defer getResp.Body.Close()
+	fingerprint := getResp.Header.Get("ETag")
+	body, err := ioutil.ReadAll(getResp.Body)
+	if err != nil {
+		t.Fatalf("reading GET /config body: %s", err)
+	}
+	var doc configDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("unmarshal config document: %s", err)
+	}
+
+	put := func(destination string) (int, error) {
+		doc := doc
+		doc.Destination = destination
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return 0, err
+		}
+
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/config", bytes.NewReader(b))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("If-Match", fingerprint)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	destinations := []string{"first.example.com", "second.example.com"}
+
+	wg.Add(2)
+	for i := range destinations {
+		i := i
+		go func() {
+			defer wg.Done()
+			status, err := put(destinations[i])
+			if err != nil {
+				t.Errorf("PUT /config: %s", err)
+				return
+			}
+			statuses[i] = status
+		}()
+	}
+	wg.Wait()
+
+	var successes, conflicts int
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			successes++
+		case http.StatusConflict:
+			conflicts++
+		}
+	}
+
+	if successes != 1 || conflicts != 1 {
+		t.Fatalf("expected exactly one writer to win (200) and the other to get 409, got statuses %v", statuses)
+	}
+}
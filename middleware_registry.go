@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	wagonexec "github.com/go-interpreter/wagon/exec"
+	"github.com/go-interpreter/wagon/wasm"
+)
+
+// middlewareType selects which executor runs a registered middleware module
+type middlewareType string
+
+const (
+	middlewareExec middlewareType = "exec"
+	middlewareHTTP middlewareType = "http"
+	middlewareWASM middlewareType = "wasm"
+)
+
+// middlewareModule is one uploaded, content-addressed transformation plugin
+type middlewareModule struct {
+	ID     string         `json:"id"`
+	Type   middlewareType `json:"type"`
+	Target string         `json:"target"` // binary path for exec, URL for http; unused for wasm
+	Binary []byte         `json:"-"`      // wasm module bytes
+}
+
+var (
+	middlewareMu sync.Mutex
+	middlewares  = map[string]*middlewareModule{}
+)
+
+// registerMiddlewareModule validates an uploaded module and returns the
+// registry entry it stores it under, used by both PostMiddlewareHandler and
+// tests that want to seed the registry directly. content is whichever of
+// target/body actually carries the uploaded bytes for mwType: target for
+// exec/http, body for wasm; the ID is content-addressed on mwType plus that
+// content (not content alone) so that, say, an exec target and an http
+// target that happen to be the same string never collide on one ID.
+func registerMiddlewareModule(mwType middlewareType, target string, body []byte) (*middlewareModule, error) {
+	if mwType == middlewareWASM {
+		module, err := wasm.DecodeModule(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("invalid WASM module: %s", err.Error())
+		}
+		if _, err := requireWASMTransformExport(module); err != nil {
+			return nil, err
+		}
+	}
+
+	content := body
+	if mwType != middlewareWASM {
+		content = []byte(target)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(mwType))
+	h.Write([]byte{0})
+	h.Write(content)
+
+	mod := &middlewareModule{
+		ID:     fmt.Sprintf("%x", h.Sum(nil)),
+		Type:   mwType,
+		Target: target,
+	}
+	if mwType == middlewareWASM {
+		mod.Binary = body
+	}
+
+	middlewareMu.Lock()
+	middlewares[mod.ID] = mod
+	middlewareMu.Unlock()
+
+	return mod, nil
+}
+
+// PostMiddlewareHandler uploads a new middleware module: POST /middleware.
+// The executor is chosen by the "type" query parameter (exec|http|wasm); for
+// "exec" and "http" the body is the target (binary path / URL) as plain
+// text, for "wasm" the body is the compiled module itself.
+func (d *DBClient) PostMiddlewareHandler(w http.ResponseWriter, req *http.Request) {
+	mwType := middlewareType(req.URL.Query().Get("type"))
+
+	defer req.Body.Close()
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body.", http.StatusBadRequest)
+		return
+	}
+
+	var mod *middlewareModule
+	switch mwType {
+	case middlewareExec, middlewareHTTP:
+		mod, err = registerMiddlewareModule(mwType, string(body), nil)
+	case middlewareWASM:
+		mod, err = registerMiddlewareModule(mwType, "", body)
+	default:
+		http.Error(w, "Unknown middleware type, expected exec, http or wasm", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Failed to register middleware module")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	b, _ := json.Marshal(mod)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// applyMiddleware runs pl through the middleware module referenced by id
+// (typically d.cfg.activeMiddlewareID once it's been set via the /config endpoint),
+// returning the transformed payload. Call this from the modify/synthesize
+// proxy code paths in place of invoking the configured middleware command
+// directly, so hot-swapped exec/http/wasm modules take effect immediately.
+func applyMiddleware(id string, pl Payload) (Payload, error) {
+	middlewareMu.Lock()
+	mod, ok := middlewares[id]
+	middlewareMu.Unlock()
+
+	if !ok {
+		return pl, fmt.Errorf("no middleware registered with id %s", id)
+	}
+
+	input, err := json.Marshal(pl)
+	if err != nil {
+		return pl, err
+	}
+
+	var output []byte
+	switch mod.Type {
+	case middlewareExec:
+		output, err = runExecMiddleware(mod, input)
+	case middlewareHTTP:
+		output, err = runHTTPMiddleware(mod, input)
+	case middlewareWASM:
+		output, err = runWASMMiddleware(mod, input)
+	default:
+		return pl, fmt.Errorf("unsupported middleware type %s", mod.Type)
+	}
+
+	if err != nil {
+		return pl, err
+	}
+
+	var transformed Payload
+	if err := json.Unmarshal(output, &transformed); err != nil {
+		return pl, fmt.Errorf("middleware returned invalid payload: %s", err.Error())
+	}
+
+	return transformed, nil
+}
+
+// execMiddlewareTimeout bounds how long the configured binary gets to
+// produce a transformed payload, matching runHTTPMiddleware's client
+// timeout so neither executor can block the calling goroutine forever.
+// A var, not a const, so tests can shorten it rather than waiting it out.
+var execMiddlewareTimeout = 10 * time.Second
+
+// runExecMiddleware pipes the payload JSON to the configured binary's
+// stdin and reads the transformed payload back from its stdout
+func runExecMiddleware(mod *middlewareModule, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execMiddlewareTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, mod.Target)
+	cmd.Stdin = bytes.NewReader(input)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("exec middleware timed out after %s", execMiddlewareTimeout)
+		}
+		return nil, fmt.Errorf("exec middleware failed: %s", err.Error())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// runHTTPMiddleware posts the payload JSON to the configured URL and
+// returns the response body as the transformed payload
+func runHTTPMiddleware(mod *middlewareModule, input []byte) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Post(mod.Target, "application/json", bytes.NewReader(input))
+	if err != nil {
+		return nil, fmt.Errorf("http middleware failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// requireWASMTransformExport validates that module exports a function (not
+// a memory/table/global that merely happens to share the name) called
+// "transform", returning that export entry. Called both at upload time in
+// registerMiddlewareModule (so a bad module is rejected with a 400 up
+// front) and from runWASMMiddleware (defence in depth, since the upload-time
+// and invocation-time decodes aren't guaranteed to agree on every module).
+func requireWASMTransformExport(module *wasm.Module) (wasm.ExportEntry, error) {
+	if module.Export != nil {
+		if entry, ok := module.Export.Entries["transform"]; ok {
+			if entry.Kind != wasm.ExternalFunction {
+				return wasm.ExportEntry{}, fmt.Errorf("wasm module's \"transform\" export is not a function")
+			}
+			return entry, nil
+		}
+	}
+	return wasm.ExportEntry{}, fmt.Errorf("wasm module does not export a \"transform\" function")
+}
+
+// wasmTransformTimeout bounds how long an uploaded WASM module's transform
+// call gets to run. Unlike the exec/http executors, wagon's interpreter
+// offers no way to cancel a function mid-execution, so a module stuck in an
+// infinite loop is abandoned (not killed) on timeout: its goroutine is left
+// running but the calling goroutine stops waiting on it.
+var wasmTransformTimeout = 10 * time.Second
+
+// runWASMMiddleware invokes mod's exported "transform" function through the
+// wagon VM. The module is expected to export a linear memory named
+// "memory" and a function "transform(ptr, len int32) int32": the host
+// writes `len` bytes of input JSON into memory at `ptr` (always 0) and
+// calls transform, which must write its output JSON back starting at the
+// same offset and return its length. That keeps the ABI to plain
+// byte-in/byte-out with no module-side allocator required. Module validity
+// (that it parses as WASM at all, and exports a "transform" function) is
+// already checked at upload time in registerMiddlewareModule; this
+// additionally requires enough declared memory to hold the payload and
+// bounds the call itself with wasmTransformTimeout.
+func runWASMMiddleware(mod *middlewareModule, input []byte) ([]byte, error) {
+	module, err := wasm.ReadModule(bytes.NewReader(mod.Binary), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode wasm module: %s", err.Error())
+	}
+
+	entry, err := requireWASMTransformExport(module)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := wagonexec.NewVM(module)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate wasm module: %s", err.Error())
+	}
+
+	memory := vm.Memory()
+	if len(memory) < len(input) {
+		return nil, fmt.Errorf("wasm module's memory (%d bytes) is too small for a %d-byte payload", len(memory), len(input))
+	}
+
+	copy(memory, input)
+
+	type execResult struct {
+		val interface{}
+		err error
+	}
+	done := make(chan execResult, 1)
+	go func() {
+		val, err := vm.ExecCode(int64(entry.Index), uint64(0), uint64(len(input)))
+		done <- execResult{val, err}
+	}()
+
+	var result execResult
+	select {
+	case result = <-done:
+	case <-time.After(wasmTransformTimeout):
+		return nil, fmt.Errorf("wasm transform timed out after %s", wasmTransformTimeout)
+	}
+	if result.err != nil {
+		return nil, fmt.Errorf("wasm transform failed: %s", result.err.Error())
+	}
+
+	// wagon hands an i32 result back as a Go uint32
+	var outLen int32
+	switch v := result.val.(type) {
+	case uint32:
+		outLen = int32(v)
+	case int32:
+		outLen = v
+	default:
+		return nil, fmt.Errorf("wasm transform returned unexpected type %T", result.val)
+	}
+	if outLen < 0 || int(outLen) > len(memory) {
+		return nil, fmt.Errorf("wasm transform returned invalid output length %d", outLen)
+	}
+
+	output := make([]byte, outLen)
+	copy(output, memory[:outLen])
+	return output, nil
+}
+
+// TransformPayload is the integration point the modify/synthesize proxy
+// code paths need to call for every captured request/response, in place of
+// invoking d.cfg.middleware (the legacy single exec command) directly, so a
+// module hot-swapped in via /middleware + PUT/PATCH /config takes effect
+// immediately. If no module has been activated (d.cfg.activeMiddlewareID is
+// empty), pl is returned unchanged so deployments that don't opt into the
+// registry behave exactly as before.
+//
+// NOTE: the modify/synthesize request-processing loop that would call this
+// (the file that currently calls d.cfg.middleware directly) isn't part of
+// this package - wiring it in is a one-line change there once that file is
+// in scope, but it can't be made from here.
+func TransformPayload(d DBClient, pl Payload) (Payload, error) {
+	id := d.cfg.activeMiddlewareID
+	if id == "" {
+		return pl, nil
+	}
+
+	return applyMiddleware(id, pl)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Test_registerMiddlewareModule_contentAddressesTarget pins the fix from
+// 974c58a: exec/http modules must be content-addressed on their target
+// (binary path / URL), not on the unused body param, or every upload of a
+// given type collides onto the same ID regardless of what it points at.
+func Test_registerMiddlewareModule_contentAddressesTarget(t *testing.T) {
+	a, err := registerMiddlewareModule(middlewareExec, "/usr/bin/transform-a", nil)
+	if err != nil {
+		t.Fatalf("registerMiddlewareModule: %s", err)
+	}
+	b, err := registerMiddlewareModule(middlewareExec, "/usr/bin/transform-b", nil)
+	if err != nil {
+		t.Fatalf("registerMiddlewareModule: %s", err)
+	}
+
+	if a.ID == b.ID {
+		t.Fatal("expected different targets to produce different module IDs")
+	}
+
+	again, err := registerMiddlewareModule(middlewareExec, "/usr/bin/transform-a", nil)
+	if err != nil {
+		t.Fatalf("registerMiddlewareModule: %s", err)
+	}
+	if again.ID != a.ID {
+		t.Fatal("expected re-registering the same target to reuse the same module ID")
+	}
+}
+
+// Test_registerMiddlewareModule_typeIsPartOfTheAddress guards against an
+// exec target and an http target with the same string colliding on one ID
+// and silently overwriting each other in the registry.
+func Test_registerMiddlewareModule_typeIsPartOfTheAddress(t *testing.T) {
+	sameTarget := "http://example.com/transform"
+
+	execMod, err := registerMiddlewareModule(middlewareExec, sameTarget, nil)
+	if err != nil {
+		t.Fatalf("registerMiddlewareModule: %s", err)
+	}
+	httpMod, err := registerMiddlewareModule(middlewareHTTP, sameTarget, nil)
+	if err != nil {
+		t.Fatalf("registerMiddlewareModule: %s", err)
+	}
+
+	if execMod.ID == httpMod.ID {
+		t.Fatal("expected an exec target and an http target with the same string to get different IDs")
+	}
+}
+
+func Test_registerMiddlewareModule_rejectsInvalidWASM(t *testing.T) {
+	if _, err := registerMiddlewareModule(middlewareWASM, "", []byte("not a wasm module")); err == nil {
+		t.Fatal("expected invalid WASM bytes to be rejected")
+	}
+}
+
+func Test_runHTTPMiddleware_postsAndReturnsBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"transformed":true}`))
+	}))
+	defer srv.Close()
+
+	mod := &middlewareModule{Type: middlewareHTTP, Target: srv.URL}
+	out, err := runHTTPMiddleware(mod, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("runHTTPMiddleware: %s", err)
+	}
+	if string(out) != `{"transformed":true}` {
+		t.Fatalf("runHTTPMiddleware output = %s", out)
+	}
+}
+
+func Test_runExecMiddleware_roundTrip(t *testing.T) {
+	mod := &middlewareModule{Type: middlewareExec, Target: "cat"}
+	out, err := runExecMiddleware(mod, []byte(`{"echoed":true}`))
+	if err != nil {
+		t.Fatalf("runExecMiddleware: %s", err)
+	}
+	if string(out) != `{"echoed":true}` {
+		t.Fatalf("runExecMiddleware output = %s", out)
+	}
+}
+
+func Test_runExecMiddleware_timesOutOnHangingProcess(t *testing.T) {
+	old := execMiddlewareTimeout
+	execMiddlewareTimeout = 50 * time.Millisecond
+	defer func() { execMiddlewareTimeout = old }()
+
+	// "yes" takes no arguments and never exits on its own (it ignores
+	// stdin and writes to stdout forever), standing in for a middleware
+	// binary that never returns.
+	mod := &middlewareModule{Type: middlewareExec, Target: "yes"}
+	if _, err := runExecMiddleware(mod, []byte(`{}`)); err == nil {
+		t.Fatal("expected a hanging exec middleware to time out")
+	}
+}
+
+// runWASMModuleMissingExport, runWASMModuleUndersizedMemory,
+// runWASMModuleBadReturnType and runWASMModuleTransformIsNotAFunction are
+// minimal, hand-assembled WASM binaries (no wat2wasm/wasm-tools dependency
+// available in this tree) used to pin runWASMMiddleware's validation paths.
+var (
+	// Just the magic number and version, no sections at all, so it decodes
+	// fine but exports nothing.
+	runWASMModuleMissingExport = []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// Exports "transform(i32,i32) i32" and "memory", but declares 0 memory
+	// pages, so the module can never hold even the smallest payload.
+	runWASMModuleUndersizedMemory = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, // magic, version
+		0x01, 0x07, 0x01, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7f, // type: (i32,i32)->i32
+		0x03, 0x02, 0x01, 0x00, // function 0 uses type 0
+		0x05, 0x03, 0x01, 0x00, 0x00, // memory: min 0 pages, no max
+		0x07, 0x16, 0x02, // export: 2 entries
+		0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, // "memory" -> mem 0
+		0x09, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x00, // "transform" -> func 0
+		0x0a, 0x06, 0x01, 0x04, 0x00, 0x41, 0x00, 0x0b, // code: i32.const 0; end
+	}
+
+	// Exports "transform(i32,i32) i64" (returns the wrong type) and a
+	// normal 1-page memory.
+	runWASMModuleBadReturnType = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, // magic, version
+		0x01, 0x07, 0x01, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, // type: (i32,i32)->i64
+		0x03, 0x02, 0x01, 0x00, // function 0 uses type 0
+		0x05, 0x03, 0x01, 0x00, 0x01, // memory: min 1 page, no max
+		0x07, 0x16, 0x02, // export: 2 entries
+		0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, // "memory" -> mem 0
+		0x09, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x00, // "transform" -> func 0
+		0x0a, 0x06, 0x01, 0x04, 0x00, 0x42, 0x00, 0x0b, // code: i64.const 0; end
+	}
+
+	// Exports "transform" as a memory, not a function, so entry.Index would
+	// point into the wrong export namespace if Kind weren't checked first.
+	runWASMModuleTransformIsNotAFunction = []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, // magic, version
+		0x05, 0x03, 0x01, 0x00, 0x01, // memory: min 1 page, no max
+		0x07, 0x0d, 0x01, // export: 1 entry
+		0x09, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x02, 0x00, // "transform" -> mem 0
+	}
+)
+
+func Test_runWASMMiddleware_missingTransformExport(t *testing.T) {
+	mod := &middlewareModule{Type: middlewareWASM, Binary: runWASMModuleMissingExport}
+	if _, err := runWASMMiddleware(mod, []byte(`{}`)); err == nil {
+		t.Fatal("expected a module with no \"transform\" export to be rejected")
+	}
+}
+
+func Test_runWASMMiddleware_undersizedMemory(t *testing.T) {
+	mod := &middlewareModule{Type: middlewareWASM, Binary: runWASMModuleUndersizedMemory}
+	if _, err := runWASMMiddleware(mod, []byte(`{}`)); err == nil {
+		t.Fatal("expected a module whose declared memory can't hold the payload to be rejected")
+	}
+}
+
+func Test_runWASMMiddleware_unexpectedReturnType(t *testing.T) {
+	mod := &middlewareModule{Type: middlewareWASM, Binary: runWASMModuleBadReturnType}
+	if _, err := runWASMMiddleware(mod, []byte(`{}`)); err == nil {
+		t.Fatal("expected a transform returning a non-i32 type to be rejected")
+	}
+}
+
+func Test_runWASMMiddleware_transformExportNotAFunction(t *testing.T) {
+	mod := &middlewareModule{Type: middlewareWASM, Binary: runWASMModuleTransformIsNotAFunction}
+	if _, err := runWASMMiddleware(mod, []byte(`{}`)); err == nil {
+		t.Fatal("expected a non-function \"transform\" export to be rejected")
+	}
+}
+
+func Test_registerMiddlewareModule_rejectsWASMWithoutTransformFunction(t *testing.T) {
+	if _, err := registerMiddlewareModule(middlewareWASM, "", runWASMModuleMissingExport); err == nil {
+		t.Fatal("expected a module with no \"transform\" export to be rejected at upload time")
+	}
+	if _, err := registerMiddlewareModule(middlewareWASM, "", runWASMModuleTransformIsNotAFunction); err == nil {
+		t.Fatal("expected a module whose \"transform\" export isn't a function to be rejected at upload time")
+	}
+}
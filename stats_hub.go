@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// These defaults are used whenever the corresponding cfg value is left
+// unset (zero), so existing deployments keep their current behaviour
+const (
+	defaultStatsPollInterval = 1 * time.Second
+	defaultStatsClientBuffer = 5
+	defaultWSIdleTimeout     = 60 * time.Second
+	defaultWSWriteTimeout    = 10 * time.Second
+)
+
+// statsHub owns the single ticker that flushes d.counter and fans the
+// result out to every connected /statsws client, replacing the old
+// one-ticker-per-connection design
+type statsHub struct {
+	d DBClient
+
+	register   chan chan []byte
+	unregister chan chan []byte
+
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+
+	once sync.Once
+}
+
+func newStatsHub(d DBClient) *statsHub {
+	return &statsHub{
+		d:          d,
+		register:   make(chan chan []byte),
+		unregister: make(chan chan []byte),
+		clients:    make(map[chan []byte]bool),
+	}
+}
+
+// start runs the hub's broadcast loop; safe to call multiple times, it only
+// ever spawns the goroutine once
+func (h *statsHub) start() {
+	h.once.Do(func() {
+		go h.run()
+	})
+}
+
+func (h *statsHub) run() {
+	interval := h.d.cfg.statsPollInterval
+	if interval <= 0 {
+		interval = defaultStatsPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-h.register:
+			h.mu.Lock()
+			h.clients[c] = true
+			h.mu.Unlock()
+
+		case c := <-h.unregister:
+			h.mu.Lock()
+			if _, ok := h.clients[c]; ok {
+				delete(h.clients, c)
+				close(c)
+			}
+			h.mu.Unlock()
+
+		case <-ticker.C:
+			var sr statsResponse
+			sr.Stats = h.d.counter.Flush()
+
+			b, err := json.Marshal(sr)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("Failed to marshal stats for broadcast")
+				continue
+			}
+
+			h.mu.Lock()
+			for c := range h.clients {
+				select {
+				case c <- b:
+				default:
+					// client isn't draining fast enough, drop it rather
+					// than block the whole broadcaster on a slow reader
+					log.Warn("Dropping slow stats websocket client")
+					delete(h.clients, c)
+					close(c)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *statsHub) join() chan []byte {
+	c := make(chan []byte, statsClientBufferSize(h.d))
+	h.register <- c
+	return c
+}
+
+func (h *statsHub) leave(c chan []byte) {
+	h.unregister <- c
+}
+
+func statsClientBufferSize(d DBClient) int {
+	if d.cfg.statsClientBuffer > 0 {
+		return d.cfg.statsClientBuffer
+	}
+	return defaultStatsClientBuffer
+}
+
+// deadlineTimer enforces an idle timeout on a websocket connection using the
+// cancel-channel-closed-by-AfterFunc pattern: every time activity is seen,
+// reset() pushes the deadline back out and done is closed once the timer
+// fires without having been reset in time.
+//
+// reset() cannot simply call timer.Reset() on an already-fired timer:
+// Reset on an expired timer reschedules the same AfterFunc to run again,
+// which would close an already-closed done channel and panic. Instead,
+// following the netstack deadlineTimer pattern, every reset mints a fresh
+// done channel and a fresh AfterFunc bound to it, so a stale firing can
+// never reach a channel a later reset is still using. Since channel() and
+// reset() are called from different goroutines (the writer loop reads
+// channel(), the read loop and its ping/pong handlers call reset()),
+// access to timer/done is serialized by mu.
+type deadlineTimer struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	done  chan struct{}
+}
+
+func newDeadlineTimer(timeout time.Duration) *deadlineTimer {
+	t := &deadlineTimer{}
+	t.arm(timeout)
+	return t
+}
+
+// arm must be called with mu held
+func (t *deadlineTimer) arm(timeout time.Duration) {
+	done := make(chan struct{})
+	t.done = done
+	t.timer = time.AfterFunc(timeout, func() { close(done) })
+}
+
+func (t *deadlineTimer) reset(timeout time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer.Stop()
+	t.arm(timeout)
+}
+
+func (t *deadlineTimer) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer.Stop()
+}
+
+// channel returns the done channel to wait on; it must be re-read on every
+// loop iteration since reset() swaps it out for a fresh one
+func (t *deadlineTimer) channel() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// runStatsClient wires one upgraded websocket connection to the hub: a
+// writer loop that forwards broadcast messages (honouring a write deadline
+// and an idle deadline), and a reader loop whose only job is to observe
+// disconnects and pings so the writer can stop promptly
+func runStatsClient(h *statsHub, conn *websocket.Conn) {
+	idleTimeout := h.d.cfg.wsIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultWSIdleTimeout
+	}
+	writeTimeout := h.d.cfg.wsWriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = defaultWSWriteTimeout
+	}
+
+	messages := h.join()
+	readErr := make(chan struct{})
+	idle := newDeadlineTimer(idleTimeout)
+
+	conn.SetPongHandler(func(string) error {
+		idle.reset(idleTimeout)
+		return nil
+	})
+
+	// gorilla consumes an incoming Ping internally before it ever reaches
+	// ReadMessage, auto-replying with a Pong of its own - so a client that
+	// only listens and pings (never sends a data message) would otherwise
+	// never postpone the idle deadline. Install our own handler that still
+	// sends the reply but also counts as activity.
+	conn.SetPingHandler(func(appData string) error {
+		idle.reset(idleTimeout)
+
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+
+	go func() {
+		defer close(readErr)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			idle.reset(idleTimeout)
+		}
+	}()
+
+	defer func() {
+		idle.stop()
+		h.leave(messages)
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case <-readErr:
+			return
+		case <-idle.channel():
+			log.Debug("Stats websocket client idle, closing connection")
+			return
+		case b, ok := <-messages:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("Got error when writing stats message")
+				return
+			}
+		}
+	}
+}
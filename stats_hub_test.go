@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func Test_statsClientBufferSize_defaultsWhenUnset(t *testing.T) {
+	d := DBClient{cfg: &Configuration{}}
+	if got := statsClientBufferSize(d); got != defaultStatsClientBuffer {
+		t.Errorf("statsClientBufferSize = %d, want default %d", got, defaultStatsClientBuffer)
+	}
+
+	d.cfg.statsClientBuffer = 42
+	if got := statsClientBufferSize(d); got != 42 {
+		t.Errorf("statsClientBufferSize = %d, want configured 42", got)
+	}
+}
+
+func Test_deadlineTimer_firesAfterTimeout(t *testing.T) {
+	dt := newDeadlineTimer(10 * time.Millisecond)
+	defer dt.stop()
+
+	select {
+	case <-dt.channel():
+	case <-time.After(time.Second):
+		t.Fatal("expected the deadline timer to fire")
+	}
+}
+
+func Test_deadlineTimer_resetPostponesFiring(t *testing.T) {
+	dt := newDeadlineTimer(100 * time.Millisecond)
+	defer dt.stop()
+
+	// reset part-way through, so the original 100ms deadline passes while
+	// the postponed one (about 160ms in) has not yet been reached
+	time.Sleep(60 * time.Millisecond)
+	dt.reset(100 * time.Millisecond)
+
+	select {
+	case <-dt.channel():
+		t.Fatal("expected reset to postpone firing")
+	case <-time.After(70 * time.Millisecond):
+	}
+
+	select {
+	case <-dt.channel():
+	case <-time.After(time.Second):
+		t.Fatal("expected the deadline timer to eventually fire")
+	}
+}
+
+func Test_deadlineTimer_resetAfterFireDoesNotPanic(t *testing.T) {
+	dt := newDeadlineTimer(5 * time.Millisecond)
+	defer dt.stop()
+
+	select {
+	case <-dt.channel():
+	case <-time.After(time.Second):
+		t.Fatal("expected the deadline timer to fire")
+	}
+
+	// Reset after the timer has already fired once used to reschedule the
+	// same AfterFunc onto the (already closed) done channel, panicking with
+	// "close of closed channel" the next time it fired.
+	dt.reset(5 * time.Millisecond)
+
+	select {
+	case <-dt.channel():
+	case <-time.After(time.Second):
+		t.Fatal("expected the deadline timer to fire again after reset")
+	}
+}
+
+// newTestStatsServer upgrades every request to a websocket and hands it to
+// runStatsClient against a fresh hub with a short idle timeout, so tests
+// can observe the idle-disconnect behaviour without waiting out the real
+// default.
+func newTestStatsServer(t *testing.T, idleTimeout time.Duration) (*httptest.Server, string) {
+	t.Helper()
+
+	h := newStatsHub(DBClient{cfg: &Configuration{
+		wsIdleTimeout:  idleTimeout,
+		wsWriteTimeout: writeTimeoutForTest,
+	}})
+	h.start()
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("upgrade: %s", err)
+			return
+		}
+		runStatsClient(h, conn)
+	}))
+
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+const writeTimeoutForTest = time.Second
+
+func Test_runStatsClient_dropsClientThatNeverPingsOrSends(t *testing.T) {
+	srv, wsURL := newTestStatsServer(t, 50*time.Millisecond)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected the server to close an idle connection")
+	}
+}
+
+func Test_runStatsClient_pingsPostponeTheIdleDeadline(t *testing.T) {
+	srv, wsURL := newTestStatsServer(t, 50*time.Millisecond)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	stopPinging := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(15 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopPinging:
+				return
+			case <-ticker.C:
+				conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond) // several multiples of the 50ms idle timeout
+	close(stopPinging)
+
+	// A timeout here (not a close frame/EOF) means the server never gave up
+	// on the connection while it was being pinged.
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected a read timeout, not a message")
+	} else if !isTimeoutErr(err) {
+		t.Fatalf("expected the connection to survive being pinged, server closed it instead: %s", err)
+	}
+}
+
+func isTimeoutErr(err error) bool {
+	type timeout interface{ Timeout() bool }
+	te, ok := err.(timeout)
+	return ok && te.Timeout()
+}
+
+func Test_statsHub_dropsSlowClient(t *testing.T) {
+	h := newStatsHub(DBClient{cfg: &Configuration{
+		statsPollInterval: 10 * time.Millisecond,
+		statsClientBuffer: 1,
+	}})
+	h.start()
+
+	slow := h.join() // never drained below, so its buffer fills fast
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		_, stillThere := h.clients[slow]
+		h.mu.Unlock()
+		if !stillThere {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("expected the broadcaster to drop a client that never drains")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-zoo/bone"
+	uuid "github.com/satori/go.uuid"
+)
+
+// maxUploadBytes caps a single resumable upload session so a client can't
+// grow server-side state without bound by opening a session and trickling
+// chunks forever
+const maxUploadBytes = 16 << 30 // 16GiB
+
+// uploadSessionTTL is how long an upload session may sit idle (no PATCH)
+// before the janitor reclaims it
+const uploadSessionTTL = 15 * time.Minute
+
+// uploadSweepInterval is how often the janitor scans for expired sessions
+const uploadSweepInterval = time.Minute
+
+// uploadSession tracks one in-progress resumable import, modeled on the
+// registry blob-upload protocol. Chunks are written into pw, which feeds a
+// json.Decoder running in a dedicated goroutine started in
+// StartUploadHandler, so payloads are parsed and stored as each chunk
+// arrives rather than after the whole body has been buffered.
+type uploadSession struct {
+	mu       sync.Mutex
+	pw       *io.PipeWriter
+	offset   int64
+	lastSeen time.Time
+	result   chan uploadResult
+	done     bool
+}
+
+// uploadResult is what the decode goroutine reports back once the pipe is
+// closed, either by PutUploadHandler finalizing the import or by the
+// session being aborted
+type uploadResult struct {
+	imported int
+	err      error
+}
+
+var (
+	uploadsMu         sync.Mutex
+	uploads           = map[string]*uploadSession{}
+	uploadJanitorOnce sync.Once
+)
+
+// startUploadJanitor launches the background sweep that evicts idle upload
+// sessions; safe to call on every request, it only ever starts the
+// goroutine once
+func startUploadJanitor() {
+	uploadJanitorOnce.Do(func() {
+		go func() {
+			for range time.Tick(uploadSweepInterval) {
+				sweepStaleUploads()
+			}
+		}()
+	})
+}
+
+// sweepStaleUploads evicts and aborts any session that hasn't seen a PATCH
+// within uploadSessionTTL, closing its pipe so the decode goroutine it owns
+// doesn't leak
+func sweepStaleUploads() {
+	cutoff := time.Now().Add(-uploadSessionTTL)
+
+	uploadsMu.Lock()
+	var stale []*uploadSession
+	for id, session := range uploads {
+		session.mu.Lock()
+		expired := session.lastSeen.Before(cutoff)
+		session.mu.Unlock()
+
+		if expired {
+			stale = append(stale, session)
+			delete(uploads, id)
+		}
+	}
+	uploadsMu.Unlock()
+
+	for _, session := range stale {
+		abortUploadSession(session, fmt.Errorf("upload session expired after %s idle", uploadSessionTTL))
+	}
+}
+
+// abortUploadSession closes session's pipe with err, unblocking its decode
+// goroutine, and is a no-op if the session was already finalized
+func abortUploadSession(session *uploadSession, err error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.done {
+		return
+	}
+	session.done = true
+	session.pw.CloseWithError(err)
+}
+
+// StartUploadHandler begins a resumable import: POST /records/uploads. It
+// spawns the goroutine that will decode and store payloads as chunks land,
+// fed by the session's pipe.
+func (d *DBClient) StartUploadHandler(w http.ResponseWriter, req *http.Request) {
+	startUploadJanitor()
+
+	id := uuid.NewV4().String()
+	pr, pw := io.Pipe()
+
+	session := &uploadSession{
+		pw:       pw,
+		lastSeen: time.Now(),
+		result:   make(chan uploadResult, 1),
+	}
+
+	go func() {
+		imported, err := importPayloadStream(d, json.NewDecoder(pr))
+		pr.CloseWithError(err)
+		session.result <- uploadResult{imported: imported, err: err}
+	}()
+
+	uploadsMu.Lock()
+	uploads[id] = session
+	uploadsMu.Unlock()
+
+	w.Header().Set("Location", fmt.Sprintf("/records/uploads/%s", id))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// PatchUploadHandler accepts the next chunk of an in-progress upload:
+// PATCH /records/uploads/{uuid}. The chunk's byte range is given by the
+// standard Content-Range request header, e.g. "bytes 0-1023/*", and must
+// start exactly where the previous chunk left off. Each chunk is streamed
+// straight into the session's decoder instead of being buffered first.
+func (d *DBClient) PatchUploadHandler(w http.ResponseWriter, req *http.Request) {
+	id := bone.GetValue(req, "uuid")
+
+	uploadsMu.Lock()
+	session, ok := uploads[id]
+	uploadsMu.Unlock()
+
+	if !ok {
+		http.Error(w, "Unknown upload", http.StatusNotFound)
+		return
+	}
+
+	start, err := parseContentRangeStart(req.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer req.Body.Close()
+
+	session.mu.Lock()
+
+	if session.done {
+		session.mu.Unlock()
+		http.Error(w, "Upload session is no longer accepting chunks", http.StatusGone)
+		return
+	}
+
+	if start != session.offset {
+		offset := session.offset
+		session.mu.Unlock()
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", offset))
+		http.Error(w, "Chunk does not continue from the last accepted offset", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if session.offset >= maxUploadBytes {
+		session.mu.Unlock()
+		http.Error(w, "Upload exceeds maximum accepted size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	budget := maxUploadBytes - session.offset
+	if req.ContentLength > budget {
+		session.mu.Unlock()
+		http.Error(w, "Upload exceeds maximum accepted size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	n, werr := io.Copy(session.pw, io.LimitReader(req.Body, budget))
+	session.offset += n
+	session.lastSeen = time.Now()
+	session.mu.Unlock()
+
+	if werr != nil {
+		uploadsMu.Lock()
+		delete(uploads, id)
+		uploadsMu.Unlock()
+		abortUploadSession(session, werr)
+
+		log.WithFields(log.Fields{
+			"error":    werr.Error(),
+			"uploadID": id,
+		}).Error("Failed to stream upload chunk")
+		http.Error(w, "Failed to read chunk", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", session.offset))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// PutUploadHandler finalizes a resumable import: PUT /records/uploads/{uuid}.
+// Any trailing bytes sent with the finalizing request are streamed in
+// first, subject to the same maxUploadBytes cap PatchUploadHandler enforces
+// (a client can't skip PATCH entirely and push an unbounded body straight
+// through PUT), then the session's pipe is closed so its decode goroutine
+// can return its final tally.
+func (d *DBClient) PutUploadHandler(w http.ResponseWriter, req *http.Request) {
+	id := bone.GetValue(req, "uuid")
+
+	uploadsMu.Lock()
+	session, ok := uploads[id]
+	if ok {
+		delete(uploads, id)
+	}
+	uploadsMu.Unlock()
+
+	if !ok {
+		http.Error(w, "Unknown upload", http.StatusNotFound)
+		return
+	}
+
+	defer req.Body.Close()
+
+	session.mu.Lock()
+	if session.done {
+		session.mu.Unlock()
+		http.Error(w, "Upload session is no longer accepting chunks", http.StatusGone)
+		return
+	}
+
+	if session.offset >= maxUploadBytes {
+		session.mu.Unlock()
+		http.Error(w, "Upload exceeds maximum accepted size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	budget := maxUploadBytes - session.offset
+	if req.ContentLength > budget {
+		session.mu.Unlock()
+		http.Error(w, "Upload exceeds maximum accepted size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	_, copyErr := io.Copy(session.pw, io.LimitReader(req.Body, budget))
+	session.done = true
+	session.pw.Close()
+	session.mu.Unlock()
+
+	if copyErr != nil {
+		log.WithFields(log.Fields{
+			"error":    copyErr.Error(),
+			"uploadID": id,
+		}).Error("Failed to stream final upload chunk")
+		http.Error(w, "Failed to read final chunk", http.StatusInternalServerError)
+		return
+	}
+
+	result := <-session.result
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	var response messageResponse
+
+	if result.err != nil {
+		if result.imported == 0 {
+			response.Message = "Bad request. Nothing to import!"
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		} else {
+			response.Message = fmt.Sprintf("Import stopped after %d requests: %s", result.imported, result.err.Error())
+			w.WriteHeader(http.StatusMultiStatus) // partially imported, client must know it was truncated
+		}
+		b, _ := json.Marshal(response)
+		w.Write(b)
+		return
+	}
+
+	response.Message = fmt.Sprintf("%d requests imported successfully", result.imported)
+	w.WriteHeader(http.StatusCreated)
+	b, _ := json.Marshal(response)
+	w.Write(b)
+}
+
+// parseContentRangeStart extracts the starting offset from a "bytes
+// start-end/total" or "bytes start-end/*" Content-Range header value
+func parseContentRangeStart(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+
+	header = strings.TrimPrefix(header, "bytes ")
+	dash := strings.Index(header, "-")
+	if dash < 0 {
+		return 0, fmt.Errorf("malformed Content-Range header")
+	}
+
+	return strconv.ParseInt(header[:dash], 10, 64)
+}
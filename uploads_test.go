@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func Test_parseContentRangeStart(t *testing.T) {
+	cases := []struct {
+		header  string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"bytes 0-1023/*", 0, false},
+		{"bytes 1024-2047/4096", 1024, false},
+		{"garbage", 0, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseContentRangeStart(c.header)
+		if c.wantErr != (err != nil) {
+			t.Errorf("parseContentRangeStart(%q) err = %v, wantErr %v", c.header, err, c.wantErr)
+			continue
+		}
+		if !c.wantErr && got != c.want {
+			t.Errorf("parseContentRangeStart(%q) = %d, want %d", c.header, got, c.want)
+		}
+	}
+}
+
+// newTestUploadSession wires a session's pipe to a goroutine that just
+// drains it, standing in for the real decode goroutine importPayloadStream
+// runs, so sweep/abort behaviour can be tested without a DBClient/cache
+func newTestUploadSession(lastSeen time.Time) *uploadSession {
+	pr, pw := io.Pipe()
+	result := make(chan uploadResult, 1)
+
+	go func() {
+		_, err := ioutil.ReadAll(pr)
+		result <- uploadResult{err: err}
+	}()
+
+	return &uploadSession{pw: pw, lastSeen: lastSeen, result: result}
+}
+
+func Test_sweepStaleUploads_evictsIdleSessions(t *testing.T) {
+	uploadsMu.Lock()
+	uploads = map[string]*uploadSession{}
+	uploadsMu.Unlock()
+
+	fresh := newTestUploadSession(time.Now())
+	stale := newTestUploadSession(time.Now().Add(-2 * uploadSessionTTL))
+
+	uploadsMu.Lock()
+	uploads["fresh"] = fresh
+	uploads["stale"] = stale
+	uploadsMu.Unlock()
+
+	sweepStaleUploads()
+
+	uploadsMu.Lock()
+	_, freshStillThere := uploads["fresh"]
+	_, staleStillThere := uploads["stale"]
+	uploadsMu.Unlock()
+
+	if !freshStillThere {
+		t.Error("expected the fresh session to survive the sweep")
+	}
+	if staleStillThere {
+		t.Error("expected the stale session to be evicted by the sweep")
+	}
+
+	select {
+	case res := <-stale.result:
+		if res.err == nil {
+			t.Error("expected the evicted session's decode goroutine to report an error")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the evicted session's pipe to be closed, unblocking its decode goroutine")
+	}
+}
+
+func Test_abortUploadSession_isIdempotent(t *testing.T) {
+	session := newTestUploadSession(time.Now())
+
+	abortUploadSession(session, io.ErrClosedPipe)
+	abortUploadSession(session, io.ErrClosedPipe) // must not panic on a double-close
+
+	select {
+	case <-session.result:
+	case <-time.After(time.Second):
+		t.Error("expected the decode goroutine to observe the abort")
+	}
+}